@@ -0,0 +1,313 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bazel is an alternate output backend for kati, parallel to the
+// ninja emitter. It doesn't walk kati's own dep graph directly: by the
+// time a $(shell ...) builtin has been compacted into a graph node, its
+// recipe has already been Eval'd into a flat string, so any structured
+// glob information (see kati.GlobSource) has to be captured by kati's
+// own graph-building code before that happens. Instead, that caller
+// assembles a []Target -- materializing srcs as normal, but setting
+// Glob instead of Srcs for a node whose recipe is a kati.GlobSource, so
+// Bazel can keep re-evaluating it instead of being handed a one-time
+// find(1) result -- and hands it to Emit.
+//
+// Emit writes "BUILD.bazel<suffix>" files, the suffix playing the same
+// role as in kati's "build<suffix>.ninja" output, so generated files can
+// be reviewed next to hand-written BUILD files during a Bazel migration
+// without clobbering them. No kati command-line flag selects this
+// backend; BUILD files are written only where a caller invokes Emit.
+package bazel
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RuleKind is the name of a Bazel rule macro, e.g. "cc_library".
+type RuleKind string
+
+const (
+	AndroidLibrary RuleKind = "android_library"
+	AndroidBinary  RuleKind = "android_binary"
+	CCLibrary      RuleKind = "cc_library"
+	FileGroup      RuleKind = "filegroup"
+	GenRule        RuleKind = "genrule"
+)
+
+// Glob describes a Target's srcs as a filesystem glob rather than a
+// materialized file list, mirroring kati.GlobSource.
+type Glob struct {
+	Roots []string
+	Exts  []string
+	// Excludes is emitted as glob()'s exclude= argument. The
+	// android:all-ext-files-under compactors always find(1) with a
+	// "-not -name \".*\"" clause (see shellutil.go), which glob() does
+	// not replicate on its own, so that clause belongs here rather
+	// than being silently dropped.
+	Excludes []string
+}
+
+// Target is the minimal shape bazel.Emit needs for one evaluated kati
+// rule. The caller (wherever it walks its own dep graph) is responsible
+// for populating it.
+type Target struct {
+	// Dir is the source directory the BUILD.bazel file belongs in,
+	// relative to the workspace root.
+	Dir string
+	// Name is the rule's name, usually the output's base name without
+	// extension.
+	Name string
+	// Class is the Android module class (LOCAL_MODULE_CLASS, or a
+	// synthetic class such as "cc_binary" for a plain executable) used
+	// to look up a RuleKind in the Mapping.
+	Class string
+	// Srcs is a materialized source file list. Ignored when Glob is set.
+	Srcs []string
+	// Glob, if set, is emitted as a glob(...) expression instead of Srcs.
+	Glob *Glob
+	// Outs and Cmd are genrule-only. Cmd is kati's own ninja recipe
+	// text (using kati's $in/$out convention); translateCmd rewrites it
+	// to Bazel's genrule substitution syntax.
+	Outs []string
+	Cmd  string
+}
+
+// Mapping describes how a module Class maps to a Bazel rule kind. It is
+// loaded from a JSON or TOML file so the mapping can evolve without a
+// kati rebuild, the same way soong keeps its own module-class tables out
+// of Go source.
+type Mapping struct {
+	// Rules maps a module class to the Bazel rule macro that should be
+	// emitted for it. A module class with no entry falls back to
+	// FileGroup, so an incomplete mapping degrades to "at least
+	// something built" rather than a hard error.
+	Rules map[string]RuleKind `json:"rules"`
+}
+
+// DefaultMapping is used when no mapping file is given. It covers the
+// module classes kati's own Android compactors (see shellutil.go) care
+// about.
+func DefaultMapping() *Mapping {
+	return &Mapping{
+		Rules: map[string]RuleKind{
+			"APPS":             AndroidBinary,
+			"JAVA_LIBRARIES":   AndroidLibrary,
+			"STATIC_LIBRARIES": CCLibrary,
+			"SHARED_LIBRARIES": CCLibrary,
+			"EXECUTABLES":      CCLibrary,
+		},
+	}
+}
+
+// LoadMapping reads a module-class -> Bazel rule kind mapping from path,
+// dispatching on its extension (.json or .toml). kati's mapping only
+// ever needs the one flat "rules" table, so rather than take on a TOML
+// library dependency this tree has no go.mod to vendor, .toml files are
+// parsed as that one flat table directly.
+func LoadMapping(path string) (*Mapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &Mapping{}
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		if err := json.NewDecoder(f).Decode(m); err != nil {
+			return nil, fmt.Errorf("bazel: parsing mapping %s: %w", path, err)
+		}
+	case ".toml":
+		if err := decodeRulesTable(f, m); err != nil {
+			return nil, fmt.Errorf("bazel: parsing mapping %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("bazel: unrecognized mapping file extension %q (want .json or .toml)", ext)
+	}
+	return m, nil
+}
+
+// decodeRulesTable parses the small subset of TOML a mapping file
+// actually uses: a single [rules] table of keys (quoted or bare) to
+// quoted-string rule names.
+func decodeRulesTable(r io.Reader, m *Mapping) error {
+	m.Rules = map[string]RuleKind{}
+	inRules := false
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			inRules = line == "[rules]"
+			continue
+		}
+		if !inRules {
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("malformed line %q", line)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+		m.Rules[key] = RuleKind(val)
+	}
+	return sc.Err()
+}
+
+// ruleKind returns the Bazel rule kind for a module class, falling back
+// to FileGroup for anything the mapping doesn't know about.
+func (m *Mapping) ruleKind(class string) RuleKind {
+	if kind, ok := m.Rules[class]; ok {
+		return kind
+	}
+	return FileGroup
+}
+
+// Emitter writes one BUILD.bazel file per directory for a []Target.
+type Emitter struct {
+	outDir  string
+	mapping *Mapping
+}
+
+// NewEmitter returns an Emitter that writes BUILD.bazel files under
+// outDir, translating module classes to rule kinds via mapping. A nil
+// mapping uses DefaultMapping.
+func NewEmitter(outDir string, mapping *Mapping) *Emitter {
+	if mapping == nil {
+		mapping = DefaultMapping()
+	}
+	return &Emitter{outDir: outDir, mapping: mapping}
+}
+
+// Emit writes a BUILD.bazel file for every directory with at least one
+// target, named "BUILD.bazel" followed by suffix (as kati's ninja output
+// is named "build<suffix>.ninja").
+func (e *Emitter) Emit(targets []Target, suffix string) error {
+	byDir := map[string][]Target{}
+	for _, t := range targets {
+		byDir[t.Dir] = append(byDir[t.Dir], t)
+	}
+
+	dirs := make([]string, 0, len(byDir))
+	for dir := range byDir {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		path := filepath.Join(e.outDir, dir, "BUILD.bazel"+suffix)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := e.emitDir(path, byDir[dir]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Emitter) emitDir(path string, targets []Target) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	for _, t := range targets {
+		e.emitRule(w, t)
+	}
+	return w.Flush()
+}
+
+// emitRule writes a single rule for t, preferring a glob(...) call over a
+// materialized srcs list whenever t.Glob is set.
+func (e *Emitter) emitRule(w io.Writer, t Target) {
+	kind := e.mapping.ruleKind(t.Class)
+
+	fmt.Fprintf(w, "%s(\n", kind)
+	fmt.Fprintf(w, "    name = %q,\n", t.Name)
+	if t.Glob != nil {
+		fmt.Fprintf(w, "    srcs = %s,\n", globExpr(t.Glob))
+	} else {
+		fmt.Fprintf(w, "    srcs = %s,\n", starlarkList(t.Srcs))
+	}
+	if kind == GenRule {
+		fmt.Fprintf(w, "    outs = %s,\n", starlarkList(t.Outs))
+		fmt.Fprintf(w, "    cmd = %q,\n", translateCmd(t.Cmd))
+	}
+	fmt.Fprintf(w, ")\n\n")
+}
+
+// globExpr renders g as a Starlark glob(...) expression, one "**/*EXT"
+// pattern per extension, rooted at each of g.Roots. g.Excludes, if set,
+// is emitted as glob()'s exclude= argument.
+func globExpr(g *Glob) string {
+	patterns := make([]string, 0, len(g.Roots)*len(g.Exts))
+	for _, root := range g.Roots {
+		for _, ext := range g.Exts {
+			patterns = append(patterns, fmt.Sprintf("%s/**/*%s", strings.TrimSuffix(root, "/"), ext))
+		}
+	}
+	if len(g.Excludes) == 0 {
+		return fmt.Sprintf("glob(%s)", starlarkList(patterns))
+	}
+	return fmt.Sprintf("glob(%s, exclude=%s)", starlarkList(patterns), starlarkList(g.Excludes))
+}
+
+// ninjaVarRE matches a bare ninja "$in"/"$out" reference, not a longer
+// variable that merely starts with the same name (e.g. "$in_newline",
+// "$out_newline", both real ninja vars kati can emit for rules using
+// response files or restat).
+var ninjaVarRE = regexp.MustCompile(`\$(in|out)\b`)
+
+// translateCmd rewrites a kati ninja recipe into Bazel's genrule
+// substitution syntax: kati/ninja's $in and $out become Bazel's $(SRCS)
+// and $(OUTS). This covers the common case of a recipe kati generated
+// for a single-output rule; a recipe that relies on ninja's per-edge
+// $in/$out scoping in some more elaborate way still needs a human to
+// port it.
+func translateCmd(cmd string) string {
+	return ninjaVarRE.ReplaceAllStringFunc(cmd, func(m string) string {
+		if m == "$in" {
+			return "$(SRCS)"
+		}
+		return "$(OUTS)"
+	})
+}
+
+func starlarkList(ss []string) string {
+	var b strings.Builder
+	b.WriteString("[")
+	for i, s := range ss {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%q", s)
+	}
+	b.WriteString("]")
+	return b.String()
+}
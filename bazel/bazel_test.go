@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMappingRuleKind(t *testing.T) {
+	m := DefaultMapping()
+	if got, want := m.ruleKind("SHARED_LIBRARIES"), CCLibrary; got != want {
+		t.Errorf("ruleKind(SHARED_LIBRARIES) = %q, want %q", got, want)
+	}
+	if got, want := m.ruleKind("SOMETHING_UNKNOWN"), FileGroup; got != want {
+		t.Errorf("ruleKind(unknown) = %q, want %q (fallback)", got, want)
+	}
+}
+
+func TestDecodeRulesTable(t *testing.T) {
+	m := &Mapping{}
+	in := strings.NewReader(`
+# comment
+[rules]
+"APPS" = "android_binary"
+EXECUTABLES = "cc_library"
+`)
+	if err := decodeRulesTable(in, m); err != nil {
+		t.Fatalf("decodeRulesTable: %v", err)
+	}
+	if got, want := m.Rules["APPS"], AndroidBinary; got != want {
+		t.Errorf(`Rules["APPS"] = %q, want %q`, got, want)
+	}
+	if got, want := m.Rules["EXECUTABLES"], CCLibrary; got != want {
+		t.Errorf(`Rules["EXECUTABLES"] = %q, want %q`, got, want)
+	}
+}
+
+func TestTranslateCmd(t *testing.T) {
+	got := translateCmd("cp $in $out")
+	want := "cp $(SRCS) $(OUTS)"
+	if got != want {
+		t.Errorf("translateCmd() = %q, want %q", got, want)
+	}
+}
+
+func TestTranslateCmdDoesNotMangleLongerVarNames(t *testing.T) {
+	got := translateCmd("cp $in_newline $out_newline")
+	want := "cp $in_newline $out_newline"
+	if got != want {
+		t.Errorf("translateCmd() = %q, want %q (longer ninja vars must be left alone)", got, want)
+	}
+}
+
+func TestGlobExpr(t *testing.T) {
+	g := &Glob{Roots: []string{"src"}, Exts: []string{".java"}}
+	got := globExpr(g)
+	want := `glob(["src/**/*.java"])`
+	if got != want {
+		t.Errorf("globExpr() = %q, want %q", got, want)
+	}
+}
+
+func TestGlobExprWithExcludes(t *testing.T) {
+	g := &Glob{Roots: []string{"src"}, Exts: []string{".java"}, Excludes: []string{"src/**/.*"}}
+	got := globExpr(g)
+	want := `glob(["src/**/*.java"], exclude=["src/**/.*"])`
+	if got != want {
+		t.Errorf("globExpr() = %q, want %q", got, want)
+	}
+}
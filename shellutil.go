@@ -17,10 +17,80 @@ package kati
 import (
 	"fmt"
 	"io"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Expr is the exported form of expr, the pattern type matched against a
+// $(shell ...) command line.
+type Expr = expr
+
+// MatchVarref matches one fully-expanded $(shell ...) argument.
+type MatchVarref = matchVarref
+
+// FuncShell is the exported form of the $(shell ...) call node passed to
+// a registered compact func.
+type FuncShell = funcShell
+
+// MustLiteralRE builds a pattern element matching re against the command
+// line, the same way mustLiteralRE does below. It panics on invalid re.
+func MustLiteralRE(re string) Expr {
+	return expr{mustLiteralRE(re)}
+}
+
+// RegisterShellBuiltin registers another $(shell ...) compaction, the
+// same way the entries in shBuiltins below do. compact is called with
+// the values captured by pattern's MatchVarref/MustLiteralRE slots, and
+// should return its *FuncShell unchanged when the fast path doesn't
+// apply, so kati falls back to running the real shell command.
+//
+// The Value compact returns is expected to honor the Value.Eval
+// contract: Eval may be called many times for the same Value, must
+// write its result to the io.Writer it is given rather than returning
+// it, and must not assume it is only ever called once per build.
+func RegisterShellBuiltin(name string, pattern Expr, compact func(*FuncShell, []Value) Value) {
+	shBuiltins = append(shBuiltins, struct {
+		name    string
+		pattern expr
+		compact func(*funcShell, []Value) Value
+	}{
+		name:    name,
+		pattern: pattern,
+		compact: compact,
+	})
+}
+
+// extClauseRE matches (capturing the whole clause, like the "(/)" group
+// in android:java_resource_file_groups below) the "-name "*.EXT"" clause(s)
+// find(1) is given to select files by extension, -o'd together when a
+// builtin (e.g. all-c-files-under) accepts more than one extension.
+const extClauseRE = `( -name "\*\.\w+"(?: -o -name "\*\.\w+")*)`
+
+// extRE pulls the individual extensions back out of a string matched by
+// extClauseRE.
+var extRE = regexp.MustCompile(`\*(\.\w+)"`)
+
+// parseExtClause extracts the extensions (each including its leading
+// dot) from a Value captured by the extClauseRE mustLiteralRE slot.
+func parseExtClause(v Value) ([]string, bool) {
+	lit, ok := v.(literal)
+	if !ok {
+		return nil, false
+	}
+	matches := extRE.FindAllStringSubmatch(string(lit), -1)
+	if len(matches) == 0 {
+		return nil, false
+	}
+	exts := make([]string, 0, len(matches))
+	for _, m := range matches {
+		exts = append(exts, m[1])
+	}
+	return exts, true
+}
+
 var shBuiltins = []struct {
 	name    string
 	pattern expr
@@ -65,45 +135,36 @@ var shBuiltins = []struct {
 		},
 	},
 	{
-		name: "android:all-java-files-under",
-		// in repo/android/build/core/definitions.mk
+		name: "android:all-ext-files-under",
+		// in repo/android/build/core/definitions.mk, the all-java-files-under
+		// and all-proto-files-under form:
 		// cd ${LOCAL_PATH} ; find -L $1 -name "*.java" -and -not -name ".*"
+		// cd $(LOCAL_PATH) ; find -L $(1) -name "*.proto" -and -not -name ".*"
+		// as well as the all-c-files-under/all-S-files-under/
+		// all-renderscript-files-under family, which -o's together a
+		// "*.EXT" clause per extension:
+		// cd $(LOCAL_PATH) ; find -L $1 -name "*.c" -o -name "*.cpp" -o -name "*.S" -and -not -name ".*"
 		pattern: expr{
 			literal("cd "),
 			matchVarref{},
 			literal(" ; find -L "),
 			matchVarref{},
-			literal(` -name "*.java" -and -not -name ".*"`),
+			// The extension clause and the trailing -and -not clause are
+			// one literal in the parsed command line, so one element
+			// matches both.
+			mustLiteralRE(`^` + extClauseRE + ` -and -not -name "\.\*"$`),
 		},
 		compact: func(sh *funcShell, v []Value) Value {
-			androidFindCache.init(nil)
-			return &funcShellAndroidFindExtFilesUnder{
-				funcShell: sh,
-				chdir:     v[0],
-				roots:     v[1],
-				ext:       ".java",
+			exts, ok := parseExtClause(v[2])
+			if !ok {
+				return sh
 			}
-		},
-	},
-	{
-		name: "android:all-proto-files-under",
-		// in repo/android/build/core/definitions.mk
-		// cd $(LOCAL_PATH) ; \
-		// find -L $(1) -name "*.proto" -and -not -name ".*"
-		pattern: expr{
-			literal("cd "),
-			matchVarref{},
-			literal(" ; find -L "),
-			matchVarref{},
-			literal(" -name \"*.proto\" -and -not -name \".*\""),
-		},
-		compact: func(sh *funcShell, v []Value) Value {
 			androidFindCache.init(nil)
 			return &funcShellAndroidFindExtFilesUnder{
 				funcShell: sh,
 				chdir:     v[0],
 				roots:     v[1],
-				ext:       ".proto",
+				exts:      exts,
 			}
 		},
 	},
@@ -231,6 +292,39 @@ var shBuiltins = []struct {
 		},
 		compact: compactShellDate,
 	},
+	{
+		name: "shell-date-utc",
+		pattern: expr{
+			mustLiteralRE(`date -u \+(\S+)`),
+		},
+		compact: compactShellDate,
+	},
+	{
+		name: "shell-date-utc-quoted",
+		pattern: expr{
+			mustLiteralRE(`date -u "\+([^"]+)"`),
+		},
+		compact: compactShellDate,
+	},
+	{
+		name: "shell-date-epoch",
+		// e.g. date -d @1700000000 +%Y, used in place of a plain
+		// $(shell date +FMT) when the Android.mk wants a reproducible
+		// timestamp of its own choosing rather than the build's. Only a
+		// literal number after "@" is folded; a variable reference there
+		// is left to the real shell.
+		pattern: expr{
+			mustLiteralRE(`date -d @(\d+) \+(\S+)`),
+		},
+		compact: compactShellDateAt,
+	},
+	{
+		name: "shell-date-epoch-quoted",
+		pattern: expr{
+			mustLiteralRE(`date -d @(\d+) "\+([^"]+)"`),
+		},
+		compact: compactShellDateAt,
+	},
 }
 
 type funcShellAndroidRot13 struct {
@@ -299,9 +393,25 @@ type funcShellAndroidFindExtFilesUnder struct {
 	*funcShell
 	chdir Value
 	roots Value
-	ext   string
+	exts  []string
 }
 
+// GlobSource is implemented by shell-builtin compactions that represent a
+// filesystem glob (the all-*-files-under family), so that alternate
+// output backends such as the bazel package can translate them back into
+// an incremental glob(...) call instead of a fixed, materialized file
+// list.
+type GlobSource interface {
+	// GlobRoots returns the (unevaluated) roots the glob is rooted at.
+	GlobRoots() Value
+	// GlobExts returns the file-name suffixes the glob matches.
+	GlobExts() []string
+}
+
+func (f *funcShellAndroidFindExtFilesUnder) GlobRoots() Value { return f.roots }
+
+func (f *funcShellAndroidFindExtFilesUnder) GlobExts() []string { return f.exts }
+
 func (f *funcShellAndroidFindExtFilesUnder) Eval(w io.Writer, ev *Evaluator) error {
 	abuf := newBuf()
 	fargs, err := ev.args(abuf, f.chdir, f.roots)
@@ -331,11 +441,19 @@ func (f *funcShellAndroidFindExtFilesUnder) Eval(w io.Writer, ev *Evaluator) err
 	}
 	buf := newBuf()
 	sw := ssvWriter{w: buf}
+	// TODO: androidFindCache.findExtFilesUnder still takes one extension
+	// per call, so a root with several extensions (all-c-files-under and
+	// friends) costs one walk per extension here instead of the single
+	// walk per traversal this compaction would ideally do. Extending
+	// findExtFilesUnder to accept a set of extensions and cache all of
+	// them from one walk is tracked as follow-up work, not done here.
 	for _, root := range roots {
-		if !androidFindCache.findExtFilesUnder(&sw, chdir, root, f.ext) {
-			freeBuf(buf)
-			logf("shellAndroidFindExtFilesUnder androidFindCache couldn't handle: call original shell")
-			return f.funcShell.Eval(w, ev)
+		for _, ext := range f.exts {
+			if !androidFindCache.findExtFilesUnder(&sw, chdir, root, ext) {
+				freeBuf(buf)
+				logf("shellAndroidFindExtFilesUnder androidFindCache couldn't handle: call original shell")
+				return f.funcShell.Eval(w, ev)
+			}
 		}
 	}
 	w.Write(buf.Bytes())
@@ -417,44 +535,159 @@ func (f *funcShellAndroidFindleaves) Eval(w io.Writer, ev *Evaluator) error {
 }
 
 var (
-	// ShellDateTimestamp is an timestamp used for $(shell date).
+	// ShellDateTimestamp is the timestamp used for $(shell date ...).
+	// If it is still zero by the time this package is initialized, it
+	// is seeded from $SOURCE_DATE_EPOCH (an integer number of seconds
+	// since the epoch, UTC), per
+	// https://reproducible-builds.org/specs/source-date-epoch/, so that
+	// Android.mk's $(shell date ...) VERSION strings don't introduce
+	// build nondeterminism by default.
 	ShellDateTimestamp time.Time
+
+	// shellDateFormatRef maps a GNU date(1) "+FMT" conversion specifier
+	// to the equivalent Go reference-time layout fragment. It covers
+	// the specifiers that translate directly; %s, %j and %N don't (see
+	// shellDateSentinels) and are handled separately.
 	shellDateFormatRef = map[string]string{
-		"%Y": "2006",
-		"%m": "01",
-		"%d": "02",
-		"%H": "15",
-		"%M": "04",
-		"%S": "05",
-		"%b": "Jan",
-		"%k": "15", // XXX
+		"%Y":  "2006",
+		"%y":  "06",
+		"%m":  "01",
+		"%d":  "02",
+		"%e":  "_2",
+		"%H":  "15",
+		"%I":  "03",
+		"%M":  "04",
+		"%S":  "05",
+		"%p":  "PM",
+		"%a":  "Mon",
+		"%A":  "Monday",
+		"%b":  "Jan",
+		"%B":  "January",
+		"%z":  "-0700",
+		"%:z": "-07:00",
+		"%Z":  "MST",
+		"%F":  "2006-01-02",
+		"%T":  "15:04:05",
+		"%k":  "15", // XXX: GNU pads with a space, Go has no such verb
+	}
+
+	// shellDateSentinels covers the GNU date(1) specifiers whose value
+	// isn't a fixed component of Go's reference time, so it can't be
+	// folded into a layout string and run through a single
+	// time.Format call the way shellDateFormatRef's entries are.
+	// Each is swapped for a placeholder before formatting and patched
+	// back in afterward with the real value, in funcShellDate.Eval.
+	shellDateSentinels = map[string]string{
+		"%s": "\x00kati:unix\x00",
+		"%j": "\x00kati:yday\x00",
+		"%N": "\x00kati:nsec\x00",
 	}
+
+	// shellDateSpecifierRE matches one GNU date(1) "+FMT" conversion
+	// specifier, so compactShellDateForTime can tell a format it fully
+	// understands from one using a specifier it doesn't, and fall back
+	// to running the real shell for the latter instead of silently
+	// emitting something wrong.
+	shellDateSpecifierRE = regexp.MustCompile(`%:?.`)
 )
 
+func init() {
+	if !ShellDateTimestamp.IsZero() {
+		return
+	}
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return
+	}
+	sec, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		logf("invalid SOURCE_DATE_EPOCH %q: %v", epoch, err)
+		return
+	}
+	ShellDateTimestamp = time.Unix(sec, 0).UTC()
+}
+
 type funcShellDate struct {
 	*funcShell
 	format string
+	t      time.Time
 }
 
+// compactShellDate constant-folds `date +FMT` and `date -u +FMT` against
+// the build's ShellDateTimestamp.
 func compactShellDate(sh *funcShell, v []Value) Value {
 	if ShellDateTimestamp.IsZero() {
 		return sh
 	}
+	return compactShellDateForTime(sh, v, ShellDateTimestamp)
+}
+
+// compactShellDateAt constant-folds `date -d @N +FMT`, where N is a
+// literal Unix timestamp of its own rather than the build's
+// ShellDateTimestamp.
+func compactShellDateAt(sh *funcShell, v []Value) Value {
+	epoch, ok := v[0].(literal)
+	if !ok {
+		return sh
+	}
+	sec, err := strconv.ParseInt(string(epoch), 10, 64)
+	if err != nil {
+		return sh
+	}
+	return compactShellDateForTime(sh, v[1:], time.Unix(sec, 0).UTC())
+}
+
+func compactShellDateForTime(sh *funcShell, v []Value, t time.Time) Value {
 	tf, ok := v[0].(literal)
 	if !ok {
 		return sh
 	}
-	tfstr := string(tf)
-	for k, v := range shellDateFormatRef {
-		tfstr = strings.Replace(tfstr, k, v, -1)
+	layout, ok := translateDateFormat(string(tf))
+	if !ok {
+		logf("compactShellDate: unhandled date specifier in %q: call original shell", string(tf))
+		return sh
 	}
 	return &funcShellDate{
 		funcShell: sh,
-		format:    tfstr,
+		format:    layout,
+		t:         t,
 	}
 }
 
+// translateDateFormat converts a GNU date(1) "+FMT" string into the
+// equivalent Go reference-time layout, substituting shellDateSentinels
+// placeholders for the specifiers time.Format can't express directly.
+// ok is false if format uses a specifier this package doesn't know how
+// to translate.
+func translateDateFormat(format string) (layout string, ok bool) {
+	for _, spec := range shellDateSpecifierRE.FindAllString(format, -1) {
+		_, known := shellDateFormatRef[spec]
+		_, special := shellDateSentinels[spec]
+		if !known && !special {
+			return "", false
+		}
+	}
+	for spec, sentinel := range shellDateSentinels {
+		format = strings.Replace(format, spec, sentinel, -1)
+	}
+	for spec, repl := range shellDateFormatRef {
+		format = strings.Replace(format, spec, repl, -1)
+	}
+	return format, true
+}
+
+// renderShellDate formats t with a layout produced by translateDateFormat,
+// patching the shellDateSentinels placeholders back in with t's real
+// Unix timestamp, day-of-year and nanosecond values.
+func renderShellDate(t time.Time, layout string) string {
+	s := t.Format(layout)
+	s = strings.Replace(s, shellDateSentinels["%s"], strconv.FormatInt(t.Unix(), 10), -1)
+	s = strings.Replace(s, shellDateSentinels["%j"], fmt.Sprintf("%03d", t.YearDay()), -1)
+	s = strings.Replace(s, shellDateSentinels["%N"], fmt.Sprintf("%09d", t.Nanosecond()), -1)
+	return s
+}
+
 func (f *funcShellDate) Eval(w io.Writer, ev *Evaluator) error {
-	fmt.Fprint(w, ShellDateTimestamp.Format(f.format))
+	fmt.Fprint(w, renderShellDate(f.t, f.format))
 	return nil
 }
@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRegisterShellBuiltin(t *testing.T) {
+	before := len(shBuiltins)
+	RegisterShellBuiltin("test:noop", Expr{literal("noop")}, func(sh *FuncShell, v []Value) Value {
+		return sh
+	})
+	if len(shBuiltins) != before+1 {
+		t.Fatalf("len(shBuiltins) = %d, want %d", len(shBuiltins), before+1)
+	}
+	if got, want := shBuiltins[len(shBuiltins)-1].name, "test:noop"; got != want {
+		t.Errorf("registered entry name = %q, want %q", got, want)
+	}
+}
+
+func TestTranslateDateFormat(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"%Y-%m-%d", "2006-01-02", true},
+		{"%F", "2006-01-02", true},
+		{"%T", "15:04:05", true},
+		{"%s", shellDateSentinels["%s"], true},
+		{"%Q", "", false},
+	} {
+		got, ok := translateDateFormat(tc.in)
+		if ok != tc.ok {
+			t.Errorf("translateDateFormat(%q) ok = %v, want %v", tc.in, ok, tc.ok)
+			continue
+		}
+		if ok && got != tc.want {
+			t.Errorf("translateDateFormat(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRenderShellDate(t *testing.T) {
+	tm := time.Date(2026, time.July, 26, 1, 2, 3, 0, time.UTC)
+	layout, ok := translateDateFormat("%Y-%m-%dT%H:%M:%S %s %j")
+	if !ok {
+		t.Fatal("translateDateFormat: want ok")
+	}
+	want := "2026-07-26T01:02:03 " + strconv.FormatInt(tm.Unix(), 10) + " 207"
+	if got := renderShellDate(tm, layout); got != want {
+		t.Errorf("renderShellDate() = %q, want %q", got, want)
+	}
+}
+
+func TestParseExtClause(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{` -name "*.java"`, []string{".java"}},
+		{` -name "*.c" -o -name "*.cpp" -o -name "*.S"`, []string{".c", ".cpp", ".S"}},
+	} {
+		got, ok := parseExtClause(literal(tc.in))
+		if !ok {
+			t.Errorf("parseExtClause(%q): want ok", tc.in)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseExtClause(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseExtClauseNotLiteral(t *testing.T) {
+	if _, ok := parseExtClause(matchVarref{}); ok {
+		t.Errorf("parseExtClause(matchVarref{}): want !ok")
+	}
+}